@@ -20,21 +20,33 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	kapi "github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	kclient "github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	clientauth "github.com/GoogleCloudPlatform/kubernetes/pkg/client/auth"
 	kfields "github.com/GoogleCloudPlatform/kubernetes/pkg/fields"
 	klabels "github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
 	tools "github.com/GoogleCloudPlatform/kubernetes/pkg/tools"
+	kutil "github.com/GoogleCloudPlatform/kubernetes/pkg/util"
 	kwatch "github.com/GoogleCloudPlatform/kubernetes/pkg/watch"
+	clientv3 "github.com/coreos/etcd/clientv3"
 	etcd "github.com/coreos/go-etcd/etcd"
 	skymsg "github.com/skynetservices/skydns/msg"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -42,21 +54,55 @@ var (
 	etcd_mutation_timeout = flag.Duration("etcd_mutation_timeout", 10*time.Second, "crash after retrying etcd mutation for a specified duration")
 	etcd_server           = flag.String("etcd-server", "http://127.0.0.1:4001", "URL to etcd server")
 	verbose               = flag.Bool("verbose", false, "log extra information")
+	resync_period         = flag.Duration("resync-period", 5*time.Minute, "how often to perform a full resync of dns records against etcd")
+	metrics_address       = flag.String("metrics-address", ":8081", "address to serve /metrics on")
+	kubecfg_file          = flag.String("kubeconfig", "", "Path to a kubeconfig/.kubernetes_auth file with authorization information; legacy alias for -auth-path, used only if -auth-path is unset")
+	master                = flag.String("master", "", "Kubernetes master address; falls back to KUBERNETES_RO_SERVICE_HOST/PORT")
+	auth_path             = flag.String("auth-path", "", "Path to a .kubernetes_auth file with authorization information")
+	api_version           = flag.String("api-version", "v1beta1", "The API version to use when talking to the Kubernetes master")
+	backend_name          = flag.String("backend", "skydns", "DNS backend to publish records to: \"skydns\" (etcd v2, SkyDNS schema) or \"coredns\" (etcd v3, CoreDNS schema)")
 )
 
-func removeDNS(record string, etcdClient *etcd.Client) error {
-	log.Printf("Removing %s from DNS", record)
-	_, err := etcdClient.Delete(skymsg.Path(record), true)
-	return err
+// Counters exposed on /metrics, updated by the resync loop.
+var (
+	recordsAdded          int64
+	recordsRemoved        int64
+	recordsDriftCorrected int64
+)
+
+// DNSBackend is the interface addDNS/removeDNS and their endpoint
+// counterparts publish records through, so that kube2sky's publishing logic
+// does not need to know which DNS server reads the records back out of
+// etcd. name is always a fully-qualified DNS name ending in ".".
+type DNSBackend interface {
+	Upsert(name string, rec skymsg.Service) error
+	Delete(name string) error
+	List(prefix string) (map[string]skymsg.Service, error)
 }
 
-func addDNS(record string, service *kapi.Service, etcdClient *etcd.Client) error {
-	// if PortalIP is not set, a DNS entry should not be created
+// removeDNS deletes every record published under record. Since addDNS may
+// have published several sibling names rooted at record (the flat A-record
+// plus one SRV record per named port), backend.Delete is expected to clean
+// up the whole subtree in one shot.
+func removeDNS(record string, backend DNSBackend) error {
+	return backend.Delete(record)
+}
+
+// addDNS publishes the flat A record and any named-port SRV records for
+// service, and returns exactly the name->value pairs it published (empty for
+// a headless service, which publishes nothing here), so callers that need to
+// know what actually changed don't have to re-derive the record set.
+func addDNS(record string, service *kapi.Service, backend DNSBackend) (map[string]skymsg.Service, error) {
+	// if PortalIP is not set, this is a headless service: publish per-pod
+	// records from its endpoints instead of a single portal-IP A record.
 	if !kapi.IsServiceIPSet(service) {
-		log.Printf("Skipping dns record for headless service: %s\n", service.Name)
-		return nil
+		log.Printf("Skipping portal-ip dns record for headless service: %s\n", service.Name)
+		return nil, nil
 	}
 
+	published := map[string]skymsg.Service{}
+
+	// Set the A record for the flat name, e.g. myservice.default.kubernetes.local.
 	svc := skymsg.Service{
 		Host:     service.Spec.PortalIP,
 		Port:     service.Spec.Port,
@@ -64,17 +110,387 @@ func addDNS(record string, service *kapi.Service, etcdClient *etcd.Client) error
 		Weight:   10,
 		Ttl:      30,
 	}
-	b, err := json.Marshal(svc)
+	if err := backend.Upsert(record, svc); err != nil {
+		return nil, err
+	}
+	published[record] = svc
+
+	// Set a SRV record for every named port (unnamed ports are skipped), e.g.
+	// _http._tcp.myservice.default.kubernetes.local., following the SkyDNS
+	// convention for named ports.
+	for i := range service.Spec.Ports {
+		port := &service.Spec.Ports[i]
+		if port.Name == "" {
+			continue
+		}
+		srvRecord := buildSRVName(port.Name, port.Protocol, record)
+		srvSvc := skymsg.Service{
+			Host:     service.Spec.PortalIP,
+			Port:     port.Port,
+			Priority: 10,
+			Weight:   10,
+			Ttl:      30,
+		}
+		if err := backend.Upsert(srvRecord, srvSvc); err != nil {
+			return nil, err
+		}
+		published[srvRecord] = srvSvc
+	}
+	return published, nil
+}
+
+// endpointRecords tracks, per headless service name, the set of record
+// names currently published for its endpoints. addDNSForEndpoints uses it
+// to remove the names that dropped out of a new Endpoints version (every
+// current name is upserted again regardless), and removeDNSForEndpoints uses it to tear down
+// exactly the names owned by that service without touching unrelated ones.
+var (
+	endpointRecordsLock sync.Mutex
+	endpointRecords     = map[string]map[string]bool{}
+)
+
+// addDNSForEndpoints publishes one A record per ready endpoint address of a
+// headless service under the flat name, plus one SRV record per named,
+// ready endpoint port. Since several addresses share the same flat name,
+// each record name is disambiguated with a short label derived from its
+// content. It reconciles against the previously published name set for
+// name so that addresses no longer present in endpoints are removed, and
+// returns the name->value pairs it published so callers that need to know
+// what actually changed don't have to re-derive the record set.
+func addDNSForEndpoints(name string, endpoints *kapi.Endpoints, backend DNSBackend) (map[string]skymsg.Service, error) {
+	published := map[string]skymsg.Service{}
+	newNames := map[string]bool{}
+	for i := range endpoints.Subsets {
+		subset := &endpoints.Subsets[i]
+		for j := range subset.Addresses {
+			addr := &subset.Addresses[j]
+
+			addrName := fmt.Sprintf("%s.%s", recordLabel(addr.IP), name)
+			svc := skymsg.Service{Host: addr.IP, Priority: 10, Weight: 10, Ttl: 30}
+			if err := backend.Upsert(addrName, svc); err != nil {
+				return nil, err
+			}
+			newNames[addrName] = true
+			published[addrName] = svc
+
+			for k := range subset.Ports {
+				port := &subset.Ports[k]
+				if port.Name == "" {
+					continue
+				}
+				srvBase := buildSRVName(port.Name, port.Protocol, name)
+				srvName := fmt.Sprintf("%s.%s", recordLabel(addr.IP, port.Name), srvBase)
+				srvSvc := skymsg.Service{Host: addr.IP, Port: port.Port, Priority: 10, Weight: 10, Ttl: 30}
+				if err := backend.Upsert(srvName, srvSvc); err != nil {
+					return nil, err
+				}
+				newNames[srvName] = true
+				published[srvName] = srvSvc
+			}
+		}
+	}
+
+	endpointRecordsLock.Lock()
+	defer endpointRecordsLock.Unlock()
+	for oldName := range endpointRecords[name] {
+		if newNames[oldName] {
+			continue
+		}
+		if err := backend.Delete(oldName); err != nil {
+			log.Printf("Failed to remove stale endpoint record %s: %v", oldName, err)
+		}
+	}
+	if len(newNames) == 0 {
+		delete(endpointRecords, name)
+	} else {
+		endpointRecords[name] = newNames
+	}
+	return published, nil
+}
+
+// removeDNSForEndpoints tears down every record that addDNSForEndpoints
+// published for name, e.g. because the headless service or its last
+// endpoint went away.
+func removeDNSForEndpoints(name string, backend DNSBackend) error {
+	endpointRecordsLock.Lock()
+	names := endpointRecords[name]
+	delete(endpointRecords, name)
+	endpointRecordsLock.Unlock()
+
+	log.Printf("Removing %s endpoint records from DNS", name)
+	for n := range names {
+		if err := backend.Delete(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildSRVName builds the SkyDNS SRV name for a named, protocol-qualified
+// port of record, e.g. "_http._tcp.myservice.default.kubernetes.local.".
+func buildSRVName(portName string, protocol kapi.Protocol, record string) string {
+	if protocol == "" {
+		protocol = kapi.ProtocolTCP
+	}
+	return fmt.Sprintf("_%s._%s.%s", portName, strings.ToLower(string(protocol)), record)
+}
+
+// recordLabel derives a short, stable, DNS-label-safe string from parts,
+// used to disambiguate record names that would otherwise collide at the
+// same base name (e.g. one A record per endpoint address).
+func recordLabel(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "/")))
+	return fmt.Sprintf("%x", sum)[:8]
+}
+
+// reverseLabelsToName joins labels ordered root-to-leaf (as found walking
+// down an etcd directory tree) back into a dotted, fully-qualified DNS name.
+func reverseLabelsToName(labels []string) string {
+	reversed := make([]string, len(labels))
+	for i, l := range labels {
+		reversed[len(labels)-1-i] = l
+	}
+	return strings.Join(reversed, ".") + "."
+}
+
+// skydnsBackend is the original backend: it publishes records into etcd v2
+// in the layout SkyDNS's etcd middleware reads, keyed by the reversed-label
+// path of a record's name, with the skymsg.Service JSON schema.
+type skydnsBackend struct {
+	client *etcd.Client
+}
+
+func newSkyDNSBackend(client *etcd.Client) DNSBackend {
+	return &skydnsBackend{client: client}
+}
+
+// Upsert writes rec under a content-hashed subkey of skymsg.Path(name)
+// rather than at name's own path. Several records can share the same name's
+// directory (e.g. a service's flat A-record name is also the parent
+// directory of its per-port SRV names), so writing straight to
+// skymsg.Path(name) would make that key a leaf and the etcd v2 directory
+// tree would refuse to nest a SRV child under it on the next write. Any
+// other leaf directly under that directory holds an earlier value of name
+// and is deleted, so a changed value replaces the old one.
+func (b *skydnsBackend) Upsert(name string, rec skymsg.Service) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	dir := skymsg.Path(name)
+	key := path.Join(dir, hashRecordValue(body))
+	resp, err := b.client.Get(dir, false, false)
+	if err != nil && !isEtcdNotFound(err) {
+		return err
+	}
+	if err == nil && resp.Node != nil {
+		for _, n := range resp.Node.Nodes {
+			if n.Dir || n.Key == key {
+				continue
+			}
+			if _, err := b.client.Delete(n.Key, false); err != nil && !isEtcdNotFound(err) {
+				return err
+			}
+		}
+	}
+	log.Printf("Setting dns record: %v -> %s:%d\n", name, rec.Host, rec.Port)
+	_, err = b.client.Set(key, string(body), uint64(0))
+	return err
+}
+
+// hashRecordValue derives a short, stable etcd key suffix from a record's
+// marshaled value, so re-publishing the same record is idempotent while
+// distinct records sharing a name's directory get distinct keys.
+func hashRecordValue(b []byte) string {
+	sum := sha1.Sum(b)
+	return fmt.Sprintf("%x", sum)[:8]
+}
+
+func (b *skydnsBackend) Delete(name string) error {
+	log.Printf("Removing %s from DNS", name)
+	_, err := b.client.Delete(skymsg.Path(name), true)
+	if err != nil && isEtcdNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *skydnsBackend) List(prefix string) (map[string]skymsg.Service, error) {
+	records := map[string]skymsg.Service{}
+
+	resp, err := b.client.Get(skymsg.Path(prefix), true, true)
+	if err != nil {
+		if isEtcdNotFound(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+	if resp.Node == nil {
+		return records, nil
+	}
+	// resp.Node's own key already encodes the whole reversed prefix (e.g.
+	// "/skydns/local/kubernetes" for "kubernetes.local"), so seed the walk
+	// with prefix's labels instead of re-deriving just resp.Node's basename,
+	// which would drop every label but the last.
+	labels := prefixLabels(prefix)
+	for _, child := range resp.Node.Nodes {
+		walkSkyDNSNode(child, labels, records)
+	}
+	return records, nil
+}
+
+// prefixLabels splits a dotted domain such as "kubernetes.local." into
+// root-to-leaf label order, matching how skymsg.Path nests it as a reversed
+// etcd directory tree, e.g. ["local", "kubernetes"].
+func prefixLabels(prefix string) []string {
+	parts := strings.Split(strings.TrimSuffix(prefix, "."), ".")
+	labels := make([]string, len(parts))
+	for i, p := range parts {
+		labels[len(parts)-1-i] = p
+	}
+	return labels
+}
+
+// walkSkyDNSNode recursively walks an etcd node tree, accumulating the path
+// of directory labels seen so far, and records a decoded skymsg.Service for
+// every leaf it finds. A leaf's own key is the content-hashed subkey Upsert
+// wrote it under, not a DNS label, so only directory basenames are folded
+// into labels; the leaf's name comes from its parent directories alone.
+func walkSkyDNSNode(node *etcd.Node, labels []string, out map[string]skymsg.Service) {
+	if node == nil {
+		return
+	}
+
+	if node.Dir {
+		labels = append(labels, path.Base(node.Key))
+		for _, child := range node.Nodes {
+			walkSkyDNSNode(child, labels, out)
+		}
+		return
+	}
+
+	var svc skymsg.Service
+	if err := json.Unmarshal([]byte(node.Value), &svc); err != nil {
+		log.Printf("Failed to decode dns record at %s: %v", node.Key, err)
+		return
+	}
+	out[reverseLabelsToName(labels)] = svc
+}
+
+// isEtcdNotFound reports whether err is an etcd v2 "key not found" error,
+// which the skydns backend treats as an empty result rather than a failure.
+func isEtcdNotFound(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcd.ErrCodeKeyNotFound
+}
+
+// coreDNSRecord is the etcd value schema used by the CoreDNS etcd plugin: a
+// leaner shape than skymsg.Service, without Priority/Weight, and with an
+// additional TargetStrip field.
+type coreDNSRecord struct {
+	Host        string `json:"host"`
+	Port        int    `json:"port,omitempty"`
+	TTL         uint32 `json:"ttl,omitempty"`
+	TargetStrip int    `json:"targetstrip,omitempty"`
+}
+
+// corednsRoot is the etcd key prefix CoreDNS's etcd plugin is configured to
+// read records from, distinct from SkyDNS's skymsg.Path root.
+const corednsRoot = "/coredns"
+
+// corednsBackend publishes records into etcd v3 in the layout the CoreDNS
+// etcd plugin reads: reversed-label keys rooted at corednsRoot, with values
+// JSON-encoded as coreDNSRecord rather than skymsg.Service.
+type corednsBackend struct {
+	client *clientv3.Client
+}
+
+func newCoreDNSBackend(client *clientv3.Client) DNSBackend {
+	return &corednsBackend{client: client}
+}
+
+func corednsPath(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return path.Join(append([]string{corednsRoot}, labels...)...)
+}
+
+func (b *corednsBackend) Upsert(name string, rec skymsg.Service) error {
+	body, err := json.Marshal(coreDNSRecord{Host: rec.Host, Port: rec.Port, TTL: uint32(rec.Ttl)})
 	if err != nil {
 		return err
 	}
-	// Set with no TTL, and hope that kubernetes events are accurate.
+	log.Printf("Setting dns record: %v -> %s:%d\n", name, rec.Host, rec.Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = b.client.Put(ctx, corednsPath(name), string(body))
+	return err
+}
 
-	log.Printf("Setting dns record: %v -> %s:%d\n", record, service.Spec.PortalIP, service.Spec.Port)
-	_, err = etcdClient.Set(skymsg.Path(record), string(b), uint64(0))
+func (b *corednsBackend) Delete(name string) error {
+	log.Printf("Removing %s from DNS", name)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Delete the record's own key plus anything nested under it (e.g. a flat
+	// A-record name is also the parent key of its SRV names), but not
+	// unrelated keys that merely share it as a string prefix (etcd v3 has no
+	// directory semantics, so "foo" is a byte-prefix of "foobar" too).
+	key := corednsPath(name)
+	if _, err := b.client.Delete(ctx, key); err != nil {
+		return err
+	}
+	_, err := b.client.Delete(ctx, key+"/", clientv3.WithPrefix())
 	return err
 }
 
+func (b *corednsBackend) List(prefix string) (map[string]skymsg.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// "/" bounds the prefix to prefix's own subtree, the same way Delete
+	// does, so a sibling record that merely shares prefix as a string prefix
+	// isn't pulled in.
+	resp, err := b.client.Get(ctx, corednsPath(prefix)+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]skymsg.Service{}
+	for _, kv := range resp.Kvs {
+		var rec coreDNSRecord
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			log.Printf("Failed to decode dns record at %s: %v", kv.Key, err)
+			continue
+		}
+		rel := strings.TrimPrefix(string(kv.Key), corednsRoot+"/")
+		name := reverseLabelsToName(strings.Split(rel, "/"))
+		records[name] = skymsg.Service{Host: rec.Host, Port: rec.Port, Ttl: int(rec.TTL)}
+	}
+	return records, nil
+}
+
+// newDNSBackend constructs the DNSBackend selected by -backend.
+func newDNSBackend() (DNSBackend, error) {
+	switch *backend_name {
+	case "coredns":
+		client, err := clientv3.New(clientv3.Config{Endpoints: []string{*etcd_server}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create etcd v3 client: %v", err)
+		}
+		return newCoreDNSBackend(client), nil
+	case "skydns":
+		client := newEtcdClient()
+		if client == nil {
+			return nil, fmt.Errorf("failed to create etcd client")
+		}
+		return newSkyDNSBackend(client), nil
+	default:
+		return nil, fmt.Errorf("unknown -backend %q, must be \"skydns\" or \"coredns\"", *backend_name)
+	}
+}
+
 // Implements retry logic for arbitrary mutator. Crashes after retrying for
 // etcd_mutation_timeout.
 func mutateEtcdOrDie(mutator func() error) {
@@ -121,38 +537,223 @@ func newEtcdClient() (client *etcd.Client) {
 	return client
 }
 
-// TODO: evaluate using pkg/client/clientcmd
+// newKubeClient builds a client for the Kubernetes API server. -master and
+// -auth-path/-kubeconfig (checked in that order, -kubeconfig being the
+// legacy alias) let kube2sky run outside the cluster against a secured,
+// HTTPS master; with none of those set it falls back to the in-cluster
+// KUBERNETES_RO_SERVICE_HOST/PORT env vars and talks to the read-only port
+// over plain HTTP, as before.
 func newKubeClient() (*kclient.Client, error) {
-	config := &kclient.Config{}
+	config := kclient.Config{}
 
-	masterHost := os.Getenv("KUBERNETES_RO_SERVICE_HOST")
-	if masterHost == "" {
-		log.Fatalf("KUBERNETES_RO_SERVICE_HOST is not defined")
+	authPath := *auth_path
+	if authPath == "" {
+		authPath = *kubecfg_file
 	}
-	masterPort := os.Getenv("KUBERNETES_RO_SERVICE_PORT")
-	if masterPort == "" {
-		log.Fatalf("KUBERNETES_RO_SERVICE_PORT is not defined")
+	if authPath != "" {
+		authInfo, err := clientauth.LoadFromFile(authPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading auth info from %s: %v", authPath, err)
+		}
+		mergedConfig, err := authInfo.MergeWithConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("error merging auth info into client config: %v", err)
+		}
+		config = mergedConfig
 	}
-	config.Host = fmt.Sprintf("http://%s:%s", masterHost, masterPort)
+
+	masterURL, err := resolveMasterURL()
+	if err != nil {
+		return nil, err
+	}
+	config.Host = masterURL
 	log.Printf("Using %s for kubernetes master", config.Host)
 
-	config.Version = "v1beta1"
+	config.Version = *api_version
 	log.Printf("Using kubernetes API %s", config.Version)
 
-	return kclient.New(config)
+	return kclient.New(&config)
+}
+
+// resolveMasterURL returns -master if set, otherwise falls back to the
+// in-cluster KUBERNETES_RO_SERVICE_HOST/PORT env vars.
+func resolveMasterURL() (string, error) {
+	if *master != "" {
+		return *master, nil
+	}
+
+	masterHost := os.Getenv("KUBERNETES_RO_SERVICE_HOST")
+	if masterHost == "" {
+		return "", fmt.Errorf("KUBERNETES_RO_SERVICE_HOST is not defined")
+	}
+	masterPort := os.Getenv("KUBERNETES_RO_SERVICE_PORT")
+	if masterPort == "" {
+		return "", fmt.Errorf("KUBERNETES_RO_SERVICE_PORT is not defined")
+	}
+	return fmt.Sprintf("http://%s:%s", masterHost, masterPort), nil
 }
 
 func buildNameString(service, namespace, domain string) string {
 	return fmt.Sprintf("%s.%s.%s.", service, namespace, domain)
 }
 
-func watchOnce(etcdClient *etcd.Client, kubeClient *kclient.Client) {
-	// Start the goroutine to produce update events.
+// resync runs resyncOnce on every tick of resync_period until stopCh is
+// closed, to repair DNS records that a dropped watch event would otherwise
+// leave missing, stale, or drifted from the current API state.
+func resync(backend DNSBackend, kubeClient *kclient.Client, limiter kutil.RateLimiter, stopCh <-chan struct{}) {
+	defer kutil.HandleCrash()
+
+	ticker := time.NewTicker(*resync_period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := resyncOnce(backend, kubeClient, limiter); err != nil {
+				log.Printf("Failed to resync dns records: %v", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// countResync buckets each record a resync pass just republished into
+// recordsAdded or recordsDriftCorrected by comparing it against the value
+// backend.List returned before the republish, doing nothing for a record
+// whose value was already correct. republished is nil for a no-op republish
+// (e.g. addDNS skips headless services entirely), so nothing is counted.
+// Only Host, Port and Ttl are compared, since the coredns backend does not
+// store Priority or Weight and its List returns them as zero.
+func countResync(republished, published map[string]skymsg.Service) {
+	for name, svc := range republished {
+		old, ok := published[name]
+		switch {
+		case !ok:
+			atomic.AddInt64(&recordsAdded, 1)
+		case old.Host != svc.Host || old.Port != svc.Port || old.Ttl != svc.Ttl:
+			atomic.AddInt64(&recordsDriftCorrected, 1)
+		}
+	}
+}
+
+// resyncOnce lists all Services and Endpoints from the API and all
+// currently-published names from the backend, then re-adds whatever is
+// missing or drifted and removes every published name that is not under
+// the flat name of a current Service or Endpoints object. A stale name
+// nested under a current flat name (e.g. the SRV record of a port that was
+// since removed from the service) is not removed. limiter throttles the
+// backend mutations so a large resync does not stampede etcd.
+func resyncOnce(backend DNSBackend, kubeClient *kclient.Client, limiter kutil.RateLimiter) error {
+	services, err := kubeClient.Services(kapi.NamespaceAll).List(klabels.Everything())
+	if err != nil {
+		return err
+	}
+	endpointsList, err := kubeClient.Endpoints(kapi.NamespaceAll).List(klabels.Everything())
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for i := range services.Items {
+		s := &services.Items[i]
+		wanted[buildNameString(s.Name, s.Namespace, *domain)] = true
+	}
+	for i := range endpointsList.Items {
+		e := &endpointsList.Items[i]
+		wanted[buildNameString(e.Name, e.Namespace, *domain)] = true
+	}
+
+	published, err := backend.List(*domain)
+	if err != nil {
+		return err
+	}
+
+	for i := range services.Items {
+		s := &services.Items[i]
+		name := buildNameString(s.Name, s.Namespace, *domain)
+		limiter.Accept()
+		republished, err := addDNS(name, s, backend)
+		if err != nil {
+			log.Printf("Failed to resync dns record %s: %v", name, err)
+			continue
+		}
+		countResync(republished, published)
+	}
+	for i := range endpointsList.Items {
+		e := &endpointsList.Items[i]
+		name := buildNameString(e.Name, e.Namespace, *domain)
+		limiter.Accept()
+		republished, err := addDNSForEndpoints(name, e, backend)
+		if err != nil {
+			log.Printf("Failed to resync endpoint dns records for %s: %v", name, err)
+			continue
+		}
+		countResync(republished, published)
+	}
+
+	// published may contain names nested below a service's flat name (SRV
+	// records, per-endpoint-address records with a disambiguating label
+	// prefix), so a published name is stale only if no wanted flat name is
+	// either it or a suffix of it.
+	for name := range published {
+		owned := wanted[name]
+		if !owned {
+			for w := range wanted {
+				if strings.HasSuffix(name, "."+w) {
+					owned = true
+					break
+				}
+			}
+		}
+		if owned {
+			continue
+		}
+		limiter.Accept()
+		if err := backend.Delete(name); err != nil {
+			log.Printf("Failed to remove stale dns record %s: %v", name, err)
+			continue
+		}
+		atomic.AddInt64(&recordsRemoved, 1)
+	}
+	return nil
+}
+
+// serveMetrics serves a plain-text /metrics endpoint exposing the resync
+// counters, for operators to watch resync correctness over time.
+func serveMetrics() {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "records_added %d\n", atomic.LoadInt64(&recordsAdded))
+		fmt.Fprintf(w, "records_removed %d\n", atomic.LoadInt64(&recordsRemoved))
+		fmt.Fprintf(w, "records_drift_corrected %d\n", atomic.LoadInt64(&recordsDriftCorrected))
+	})
+	log.Printf("Serving /metrics on %s", *metrics_address)
+	if err := http.ListenAndServe(*metrics_address, nil); err != nil {
+		log.Printf("Failed to serve /metrics: %v", err)
+	}
+}
+
+// watchOnce runs a single pass of the services/endpoints watches until both
+// of them have ended, each either on its own (e.g. a watch error or the API
+// server closing the connection) or because stopCh is closed; it drains any
+// in-flight updates from the watchers before returning. A watch that ends on
+// its own does not stop the other one.
+func watchOnce(backend DNSBackend, kubeClient *kclient.Client, stopCh <-chan struct{}) {
+	// Start the two goroutines that produce update events, fanning both of
+	// them into the same updates channel. Neither goroutine closes the
+	// channel directly, since the other may still be writing to it; instead
+	// updates is closed once both have finished.
 	updates := make(chan serviceUpdate)
-	startWatching(kubeClient.Services(kapi.NamespaceAll), updates)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	startWatching(kubeClient.Services(kapi.NamespaceAll), updates, &wg, stopCh)
+	startWatchingEndpoints(kubeClient.Endpoints(kapi.NamespaceAll), updates, &wg, stopCh)
+	go func() {
+		wg.Wait()
+		close(updates)
+	}()
 
-	// This loop will break if the channel closes, which is how the
-	// goroutine signals an error.
+	// This loop will break once the channel closes, which happens only
+	// after both goroutines have finished, on error or on shutdown.
 	for ev := range updates {
 		if *verbose {
 			log.Printf("Received update event: %#v", ev)
@@ -162,25 +763,36 @@ func watchOnce(etcdClient *etcd.Client, kubeClient *kclient.Client) {
 			for i := range ev.Services {
 				s := &ev.Services[i]
 				name := buildNameString(s.Name, s.Namespace, *domain)
-				mutateEtcdOrDie(func() error { return addDNS(name, s, etcdClient) })
+				mutateEtcdOrDie(func() error { _, err := addDNS(name, s, backend); return err })
 			}
 		case RemoveService:
 			for i := range ev.Services {
 				s := &ev.Services[i]
 				name := buildNameString(s.Name, s.Namespace, *domain)
-				mutateEtcdOrDie(func() error { return removeDNS(name, etcdClient) })
+				mutateEtcdOrDie(func() error { return removeDNS(name, backend) })
+			}
+		case SetEndpoints, AddEndpoints:
+			for i := range ev.Endpoints {
+				e := &ev.Endpoints[i]
+				name := buildNameString(e.Name, e.Namespace, *domain)
+				mutateEtcdOrDie(func() error { _, err := addDNSForEndpoints(name, e, backend); return err })
+			}
+		case RemoveEndpoints:
+			for i := range ev.Endpoints {
+				e := &ev.Endpoints[i]
+				name := buildNameString(e.Name, e.Namespace, *domain)
+				mutateEtcdOrDie(func() error { return removeDNSForEndpoints(name, backend) })
 			}
 		}
 	}
-	//TODO: fully resync periodically.
 }
 
 func main() {
 	flag.Parse()
 
-	etcdClient := newEtcdClient()
-	if etcdClient == nil {
-		log.Fatal("Failed to create etcd client")
+	backend, err := newDNSBackend()
+	if err != nil {
+		log.Fatalf("Failed to create dns backend: %v", err)
 	}
 
 	kubeClient, err := newKubeClient()
@@ -188,10 +800,70 @@ func main() {
 		log.Fatalf("Failed to create a kubernetes client: %v", err)
 	}
 
-	// In case of error, the watch will be aborted.  At that point we just
-	// retry.
+	stopCh := make(chan struct{})
+	go waitForShutdownSignal(stopCh)
+
+	go serveMetrics()
+
+	resyncLimiter := kutil.NewTokenBucketRateLimiter(1, 10)
+	go resync(backend, kubeClient, resyncLimiter, stopCh)
+
+	runWatchLoop(backend, kubeClient, stopCh)
+}
+
+// waitForShutdownSignal blocks until SIGINT or SIGTERM is received and then
+// closes stopCh, so every long-running goroutine gets a chance to cancel
+// its watch, drain any in-flight etcd mutation, and return.
+func waitForShutdownSignal(stopCh chan<- struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("Received signal %v, shutting down", sig)
+	close(stopCh)
+}
+
+// runWatchLoop repeatedly calls watchOnce until stopCh is closed. A broken
+// or unreachable API server makes watchOnce return almost immediately, so
+// reconnect attempts are paced with an exponential backoff (capped at
+// maxWatchRetryDelay) instead of hammering kube and etcd in a hot loop; the
+// backoff resets once a watch has stayed up long enough to be considered
+// healthy again.
+func runWatchLoop(backend DNSBackend, kubeClient *kclient.Client, stopCh <-chan struct{}) {
+	const (
+		initialWatchRetryDelay = 1 * time.Second
+		maxWatchRetryDelay     = 30 * time.Second
+	)
+	delay := initialWatchRetryDelay
+
 	for {
-		watchOnce(etcdClient, kubeClient)
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		started := time.Now()
+		watchOnce(backend, kubeClient, stopCh)
+
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		if time.Since(started) > maxWatchRetryDelay {
+			delay = initialWatchRetryDelay
+		}
+		log.Printf("Watch ended, retrying in %v", delay)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxWatchRetryDelay {
+			delay = maxWatchRetryDelay
+		}
 	}
 }
 
@@ -204,6 +876,13 @@ type servicesWatcher interface {
 	Watch(label klabels.Selector, field kfields.Selector, resourceVersion string) (kwatch.Interface, error)
 }
 
+// endpointsWatcher is capable of listing and watching for changes to
+// endpoints across ALL namespaces.
+type endpointsWatcher interface {
+	List(label klabels.Selector) (*kapi.EndpointsList, error)
+	Watch(label klabels.Selector, field kfields.Selector, resourceVersion string) (kwatch.Interface, error)
+}
+
 type operation int
 
 // These are the available operation types.
@@ -211,31 +890,55 @@ const (
 	SetServices operation = iota
 	AddService
 	RemoveService
+	SetEndpoints
+	AddEndpoints
+	RemoveEndpoints
 )
 
-// serviceUpdate describes an operation of services, sent on the channel.
+// serviceUpdate describes an operation of services or endpoints, sent on the
+// channel.
 //
-// You can add or remove a single service by sending an array of size one with
-// Op == AddService|RemoveService.  For setting the state of the system to a given state, just
-// set Services as desired and Op to SetServices, which will reset the system
-// state to that specified in this operation for this source channel. To remove
-// all services, set Services to empty array and Op to SetServices
+// You can add or remove a single service/endpoints object by sending an
+// array of size one with Op == AddService|RemoveService|AddEndpoints|RemoveEndpoints.
+// A full listing is sent with Services (or Endpoints) set to every object
+// and Op set to SetServices (or SetEndpoints); every listed object is then
+// published, but objects absent from the listing are not removed.
 type serviceUpdate struct {
-	Services []kapi.Service
-	Op       operation
+	Services  []kapi.Service
+	Endpoints []kapi.Endpoints
+	Op        operation
 }
 
-// startWatching launches a goroutine that watches for changes to services.
-func startWatching(watcher servicesWatcher, updates chan<- serviceUpdate) {
+// startWatching launches a goroutine that watches for changes to services
+// until stopCh is closed. wg.Done is called once the watch ends, whether
+// due to error or the process shutting down. A panic inside the watch is
+// recovered and logged so it cannot take down the whole process.
+func startWatching(watcher servicesWatcher, updates chan<- serviceUpdate, wg *sync.WaitGroup, stopCh <-chan struct{}) {
 	serviceVersion := ""
-	go watchLoop(watcher, updates, &serviceVersion)
+	go func() {
+		defer wg.Done()
+		defer kutil.HandleCrash()
+		watchLoop(watcher, updates, &serviceVersion, stopCh)
+	}()
 }
 
-// watchLoop loops forever looking for changes to services.  If an error occurs
-// it will close the channel and return.
-func watchLoop(svcWatcher servicesWatcher, updates chan<- serviceUpdate, resourceVersion *string) {
-	defer close(updates)
+// startWatchingEndpoints launches a goroutine that watches for changes to
+// endpoints until stopCh is closed. wg.Done is called once the watch ends,
+// whether due to error or the process shutting down. A panic inside the
+// watch is recovered and logged so it cannot take down the whole process.
+func startWatchingEndpoints(watcher endpointsWatcher, updates chan<- serviceUpdate, wg *sync.WaitGroup, stopCh <-chan struct{}) {
+	endpointsVersion := ""
+	go func() {
+		defer wg.Done()
+		defer kutil.HandleCrash()
+		watchEndpointsLoop(watcher, updates, &endpointsVersion, stopCh)
+	}()
+}
 
+// watchLoop loops looking for changes to services until an error occurs or
+// stopCh is closed, in either case returning to let the caller signal
+// completion.
+func watchLoop(svcWatcher servicesWatcher, updates chan<- serviceUpdate, resourceVersion *string, stopCh <-chan struct{}) {
 	if len(*resourceVersion) == 0 {
 		services, err := svcWatcher.List(klabels.Everything())
 		if err != nil {
@@ -256,6 +959,8 @@ func watchLoop(svcWatcher servicesWatcher, updates chan<- serviceUpdate, resourc
 	ch := watcher.ResultChan()
 	for {
 		select {
+		case <-stopCh:
+			return
 		case event, ok := <-ch:
 			if !ok {
 				log.Printf("watchLoop channel closed")
@@ -290,3 +995,64 @@ func sendUpdate(updates chan<- serviceUpdate, event kwatch.Event, service *kapi.
 		log.Fatalf("Unknown event.Type: %v", event.Type)
 	}
 }
+
+// watchEndpointsLoop loops looking for changes to endpoints until an error
+// occurs or stopCh is closed, in either case returning to let the caller
+// signal completion.
+func watchEndpointsLoop(epWatcher endpointsWatcher, updates chan<- serviceUpdate, resourceVersion *string, stopCh <-chan struct{}) {
+	if len(*resourceVersion) == 0 {
+		endpoints, err := epWatcher.List(klabels.Everything())
+		if err != nil {
+			log.Printf("Failed to load endpoints: %v", err)
+			return
+		}
+		*resourceVersion = endpoints.ResourceVersion
+		updates <- serviceUpdate{Op: SetEndpoints, Endpoints: endpoints.Items}
+	}
+
+	watcher, err := epWatcher.Watch(klabels.Everything(), kfields.Everything(), *resourceVersion)
+	if err != nil {
+		log.Printf("Failed to watch for endpoints changes: %v", err)
+		return
+	}
+	defer watcher.Stop()
+
+	ch := watcher.ResultChan()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event, ok := <-ch:
+			if !ok {
+				log.Printf("watchEndpointsLoop channel closed")
+				return
+			}
+
+			if event.Type == kwatch.Error {
+				if status, ok := event.Object.(*kapi.Status); ok {
+					log.Printf("Error during endpoints watch: %#v", status)
+					return
+				}
+				log.Fatalf("Received unexpected error: %#v", event.Object)
+			}
+
+			if endpoints, ok := event.Object.(*kapi.Endpoints); ok {
+				sendEndpointsUpdate(updates, event, endpoints, resourceVersion)
+				continue
+			}
+		}
+	}
+}
+
+func sendEndpointsUpdate(updates chan<- serviceUpdate, event kwatch.Event, endpoints *kapi.Endpoints, resourceVersion *string) {
+	*resourceVersion = endpoints.ResourceVersion
+
+	switch event.Type {
+	case kwatch.Added, kwatch.Modified:
+		updates <- serviceUpdate{Op: AddEndpoints, Endpoints: []kapi.Endpoints{*endpoints}}
+	case kwatch.Deleted:
+		updates <- serviceUpdate{Op: RemoveEndpoints, Endpoints: []kapi.Endpoints{*endpoints}}
+	default:
+		log.Fatalf("Unknown event.Type: %v", event.Type)
+	}
+}